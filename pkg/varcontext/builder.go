@@ -0,0 +1,327 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package varcontext builds up the set of variables available to a service
+// broker operation (provision, bind, etc.) by layering multiple sources -
+// service defaults, tile configuration, user-supplied parameters - and
+// evaluating `${...}` templates against the accumulated result.
+package varcontext
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/hashicorp/go-multierror"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// DefaultVariable is a single named value, with an optional template, to be
+// merged into a ContextBuilder by MergeDefaults. Default may either be a
+// literal value or a string containing a `${...}` template, in which case it
+// is evaluated against the context accumulated so far.
+type DefaultVariable struct {
+	Name      string
+	Default   interface{}
+	Overwrite bool
+}
+
+// ContextBuilder accumulates key/value pairs from multiple sources in the
+// order its Merge* methods are called, with later calls taking precedence
+// over earlier ones. Errors encountered along the way are collected rather
+// than returned immediately, so callers can chain calls fluently and check
+// for failures once at Build().
+type ContextBuilder struct {
+	context         map[string]interface{}
+	constants       map[string]interface{}
+	providers       []providerEntry
+	provenance      map[string][]Origin
+	mergeIndex      int
+	errs            *multierror.Error
+	schemas         []gojsonschema.JSONLoader
+	compiledSchemas []*gojsonschema.Schema
+}
+
+// Builder creates a new, empty ContextBuilder.
+func Builder() *ContextBuilder {
+	return &ContextBuilder{
+		context:   make(map[string]interface{}),
+		constants: make(map[string]interface{}),
+	}
+}
+
+// SetEvalConstants registers values that `${...}` templates may reference
+// but that later merges can't accidentally overwrite.
+func (builder *ContextBuilder) SetEvalConstants(constants map[string]interface{}) *ContextBuilder {
+	for k, v := range constants {
+		builder.constants[k] = v
+	}
+	return builder
+}
+
+// MergeMap merges the entries of other into the context, with keys in other
+// overwriting any existing entries of the same name.
+func (builder *ContextBuilder) MergeMap(other map[string]interface{}) *ContextBuilder {
+	builder.applyMap("MergeMap", other)
+	return builder
+}
+
+// MergeJsonObject unmarshals raw as a JSON object and merges its entries
+// into the context. A blank message is treated as an empty object.
+func (builder *ContextBuilder) MergeJsonObject(raw json.RawMessage) *ContextBuilder {
+	if len(raw) == 0 {
+		return builder
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	builder.applyMap("MergeJsonObject", parsed)
+	return builder
+}
+
+// MergeStruct marshals v to JSON and merges the result into the context, so
+// JSON tags on v control the resulting key names.
+func (builder *ContextBuilder) MergeStruct(v interface{}) *ContextBuilder {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	builder.applyMap("MergeStruct", parsed)
+	return builder
+}
+
+// MergeDefaults merges a list of DefaultVariables. Each Default is evaluated
+// as a template against the context accumulated so far; a key already
+// present in the context is left untouched unless its DefaultVariable sets
+// Overwrite.
+func (builder *ContextBuilder) MergeDefaults(defaults []DefaultVariable) *ContextBuilder {
+	index := builder.beginMerge()
+
+	for _, d := range defaults {
+		if d.Default == nil {
+			continue
+		}
+
+		if _, exists := builder.context[d.Name]; exists && !d.Overwrite {
+			continue
+		}
+
+		if template, ok := d.Default.(string); ok {
+			builder.setEvalResult("MergeDefaults", index, d.Name, template)
+			continue
+		}
+
+		builder.context[d.Name] = d.Default
+		builder.recordOrigin(d.Name, Origin{Source: "MergeDefaults", Index: index, RawValue: d.Default})
+	}
+	return builder
+}
+
+// MergeEvalResult evaluates template against the accumulated context and
+// constants, storing the result under name. template may be a literal value
+// or contain one or more `${...}` expressions.
+func (builder *ContextBuilder) MergeEvalResult(name, template string) *ContextBuilder {
+	builder.setEvalResult("MergeEvalResult", builder.beginMerge(), name, template)
+	return builder
+}
+
+// Build aggregates any errors encountered during the merge process, runs
+// any schemas registered with Validate/ValidateSchema against the result,
+// and, if nothing failed, returns the resolved VarContext.
+func (builder *ContextBuilder) Build() (*VarContext, error) {
+	// Schemas run even when a merge or template already failed, so every
+	// failure comes back in one error. They append to a copy of the recorded
+	// errors, so calling Build() again doesn't report a violation twice.
+	recorded := builder.errs
+	if recorded != nil {
+		builder.errs = &multierror.Error{Errors: append([]error{}, recorded.Errors...), ErrorFormat: errorListFormat}
+	}
+	builder.validate()
+	all := builder.errs
+	builder.errs = recorded
+
+	if err := all.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	return newVarContext(builder.context, builder.provenance), nil
+}
+
+// BuildMap is a convenience wrapper around Build that returns a plain map
+// rather than a VarContext.
+func (builder *ContextBuilder) BuildMap() (map[string]interface{}, error) {
+	vc, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+	return vc.ToMap(), nil
+}
+
+func (builder *ContextBuilder) appendErr(err error) {
+	merr := multierror.Append(builder.errs, err)
+	merr.ErrorFormat = errorListFormat
+	builder.errs = merr
+}
+
+// beginMerge advances the merge order counter and returns its new value, so
+// every key touched by a single Merge* call can share one Origin.Index.
+func (builder *ContextBuilder) beginMerge() int {
+	builder.mergeIndex++
+	return builder.mergeIndex
+}
+
+// recordOrigin appends an Origin to key's provenance.
+func (builder *ContextBuilder) recordOrigin(key string, origin Origin) {
+	if builder.provenance == nil {
+		builder.provenance = make(map[string][]Origin)
+	}
+	builder.provenance[key] = append(builder.provenance[key], origin)
+}
+
+// applyMap is the shared implementation behind MergeMap, MergeJsonObject and
+// MergeStruct: it writes every entry of values into the context and records
+// its provenance under source, all sharing one merge-order index.
+func (builder *ContextBuilder) applyMap(source string, values map[string]interface{}) {
+	index := builder.beginMerge()
+	for k, v := range values {
+		builder.context[k] = v
+		builder.recordOrigin(k, Origin{Source: source, Index: index, RawValue: v})
+	}
+}
+
+// setEvalResult evaluates template and, on success, stores the result under
+// name and records its provenance; errors are deferred the same way
+// appendErr defers everything else.
+func (builder *ContextBuilder) setEvalResult(source string, index int, name, template string) {
+	result, err := builder.evaluate(template)
+	if err != nil {
+		builder.appendErr(fmt.Errorf("couldn't compute the value for %q, template: %q, %v", name, template, err))
+		return
+	}
+
+	builder.context[name] = result
+	builder.recordOrigin(name, Origin{Source: source, Index: index, RawValue: template})
+}
+
+// errorListFormat renders accumulated errors as a single line, matching the
+// compact style the rest of the broker uses for surfaced merge failures.
+func errorListFormat(es []error) string {
+	points := make([]string, len(es))
+	for i, err := range es {
+		points[i] = err.Error()
+	}
+	return fmt.Sprintf("%d error(s) occurred: %s", len(es), strings.Join(points, "; "))
+}
+
+var templateExprPattern = regexp.MustCompile(`\$\{([^{}]*)\}`)
+
+// evaluate expands every `${...}` expression found in template against the
+// accumulated context and constants. A template with no expressions is
+// returned unchanged.
+func (builder *ContextBuilder) evaluate(template string) (string, error) {
+	if !strings.Contains(template, "${") {
+		return template, nil
+	}
+
+	vars := builder.evalVars()
+
+	var evalErr error
+	result := templateExprPattern.ReplaceAllStringFunc(template, func(match string) string {
+		if evalErr != nil {
+			return match
+		}
+
+		expr := match[2 : len(match)-1]
+		value, err := gval.Evaluate(expr, vars, gval.Function("assert", assertFn))
+		if err != nil {
+			if wrapped := errors.Unwrap(err); wrapped != nil {
+				err = wrapped
+			}
+			evalErr = err
+			return match
+		}
+
+		return fmt.Sprintf("%v", value)
+	})
+
+	if evalErr != nil {
+		return "", evalErr
+	}
+	return result, nil
+}
+
+// templateVars is a gval.Selector backing `${...}` expressions. Unlike a
+// plain map it reports an error for an unknown key rather than silently
+// resolving to nil - a typo'd reference like "${regoin}" should fail the
+// merge, not disappear - and it consults the full composite of registered
+// ContextProviders, not just the in-memory context.
+type templateVars struct {
+	builder *ContextBuilder
+}
+
+func (v templateVars) SelectGVal(_ context.Context, key string) (interface{}, error) {
+	if value, ok := v.builder.constants[key]; ok {
+		return value, nil
+	}
+	if value, ok := v.builder.Lookup(key); ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("no parameter %q", key)
+}
+
+// evalVars returns the gval.Selector that resolves the variables visible
+// to a template: the composite of registered providers, with the
+// constants always taking precedence so user data can never shadow them.
+func (builder *ContextBuilder) evalVars() templateVars {
+	return templateVars{builder: builder}
+}
+
+// assertFn backs the `assert(condition, message)` template function used to
+// fail template evaluation early with a descriptive error.
+func assertFn(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("assert: requires a condition argument")
+	}
+
+	ok, isBool := args[0].(bool)
+	if !isBool {
+		return nil, fmt.Errorf("assert: condition must be a boolean")
+	}
+
+	if !ok {
+		msg := "assertion failed"
+		if len(args) > 1 {
+			msg = fmt.Sprintf("%v", args[1])
+		}
+		return nil, fmt.Errorf("assert: Assertion failed: %s", msg)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format identifies the serialization of a document passed to MergeReader.
+type Format int
+
+const (
+	// FormatJSON decodes a document as a JSON object.
+	FormatJSON Format = iota
+	// FormatYAML decodes a document as a YAML mapping.
+	FormatYAML
+)
+
+// MergeFile loads a YAML or JSON document from disk, based on its extension
+// (.yaml/.yml/.json), and deep-merges it into the context, the same way
+// MergeMapDeep does: nested objects are merged key by key rather than one
+// file's object replacing another's wholesale. MergeFiles merges several in
+// order so later files take precedence, compose-file style.
+func (builder *ContextBuilder) MergeFile(path string) *ContextBuilder {
+	format, err := formatFromExtension(path)
+	if err != nil {
+		builder.appendErr(fmt.Errorf("%s: %v", path, err))
+		return builder
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		builder.appendErr(fmt.Errorf("%s: %v", path, err))
+		return builder
+	}
+	defer f.Close()
+
+	return builder.mergeDocument(f, format, path)
+}
+
+// MergeFiles loads and merges MergeFile(path) for each path in order, later
+// files taking precedence over earlier ones.
+func (builder *ContextBuilder) MergeFiles(paths ...string) *ContextBuilder {
+	for _, path := range paths {
+		builder.MergeFile(path)
+	}
+	return builder
+}
+
+// MergeReader decodes r as the given Format and merges the result into the
+// context, for callers that already have a stream rather than a path on
+// disk.
+func (builder *ContextBuilder) MergeReader(r io.Reader, format Format) *ContextBuilder {
+	return builder.mergeDocument(r, format, "")
+}
+
+func (builder *ContextBuilder) mergeDocument(r io.Reader, format Format, source string) *ContextBuilder {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		builder.appendErr(wrapSourceErr(source, err))
+		return builder
+	}
+
+	parsed, err := decodeDocument(raw, format)
+	if err != nil {
+		builder.appendErr(wrapSourceErr(source, err))
+		return builder
+	}
+
+	evaluated, err := builder.evaluateTemplates(parsed)
+	if err != nil {
+		builder.appendErr(wrapSourceErr(source, err))
+		return builder
+	}
+
+	sourceName := "MergeReader"
+	if source != "" {
+		sourceName = fmt.Sprintf("MergeFile(%s)", source)
+	}
+	builder.applyMapDeep(sourceName, evaluated.(map[string]interface{}), MergeOptions{})
+
+	// applyMapDeep records the evaluated values; point each Origin it just
+	// added back at the document's own value from before template evaluation.
+	for k, raw := range parsed {
+		if origins := builder.provenance[k]; len(origins) > 0 && origins[len(origins)-1].Index == builder.mergeIndex {
+			origins[len(origins)-1].RawValue = raw
+		}
+	}
+	return builder
+}
+
+func decodeDocument(raw []byte, format Format) (map[string]interface{}, error) {
+	parsed := map[string]interface{}{}
+	if len(raw) == 0 {
+		return parsed, nil
+	}
+
+	var err error
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(raw, &parsed)
+	default:
+		err = json.Unmarshal(raw, &parsed)
+	}
+	return parsed, err
+}
+
+func formatFromExtension(path string) (Format, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	default:
+		return FormatJSON, fmt.Errorf("couldn't determine format from extension %q, expected .yaml, .yml or .json", filepath.Ext(path))
+	}
+}
+
+func wrapSourceErr(source string, err error) error {
+	if source == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", source, err)
+}
+
+// evaluateTemplates walks v, which must be the result of unmarshaling a
+// JSON or YAML document, evaluating `${...}` templates in every string it
+// finds against the context accumulated so far.
+func (builder *ContextBuilder) evaluateTemplates(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return builder.evaluate(val)
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, entry := range val {
+			resolved, err := builder.evaluateTemplates(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			out[k] = resolved
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, entry := range val {
+			resolved, err := builder.evaluateTemplates(entry)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+
+	default:
+		return val, nil
+	}
+}
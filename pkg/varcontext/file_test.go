@@ -0,0 +1,92 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("couldn't write test fixture %q: %v", path, err)
+	}
+	return path
+}
+
+func TestContextBuilder_MergeFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := writeTestFile(t, dir, "base.yaml", "region: us-central1\nlabels:\n  team: core\n")
+	override := writeTestFile(t, dir, "override.json", `{"labels": {"env": "${region}"}}`)
+
+	vc, err := Builder().MergeFiles(base, override).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"region": "us-central1",
+		"labels": map[string]interface{}{"team": "core", "env": "us-central1"},
+	}
+	if !reflect.DeepEqual(vc.ToMap(), expected) {
+		t.Errorf("Expected: %v, got: %v", expected, vc.ToMap())
+	}
+}
+
+func TestContextBuilder_MergeFiles_NumericTypesAcrossFormats(t *testing.T) {
+	dir := t.TempDir()
+	base := writeTestFile(t, dir, "base.yaml", "count: 5\n")
+	override := writeTestFile(t, dir, "override.json", `{"count": 6}`)
+
+	vc, err := Builder().MergeFiles(base, override).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := vc.ToMap()["count"]; got != float64(6) {
+		t.Errorf("expected count=6, got %v", got)
+	}
+}
+
+func TestContextBuilder_MergeFiles_PartialConflictKeepsSiblings(t *testing.T) {
+	dir := t.TempDir()
+	base := writeTestFile(t, dir, "base.yaml", "labels:\n  env: prod\n  team: core\n")
+	override := writeTestFile(t, dir, "override.json", `{"labels": {"env": 5, "region": "us"}}`)
+
+	builder := Builder().MergeFiles(base, override)
+	if _, err := builder.Build(); err == nil || !strings.Contains(err.Error(), "labels.env: cannot merge") {
+		t.Fatalf("expected a labels.env conflict error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"env": "prod", "team": "core", "region": "us"}
+	if got := builder.context["labels"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected only the conflicting key to be reverted, got: %v", got)
+	}
+}
+
+func TestContextBuilder_MergeFile_UnknownExtension(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "config.toml", "region = \"us-central1\"")
+
+	_, err := Builder().MergeFile(path).Build()
+	if err == nil || !strings.Contains(err.Error(), "couldn't determine format") {
+		t.Errorf("expected a format error, got: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// MergeOptions controls how MergeMapDeep (and friends) reconcile values
+// that are present on both sides of a merge.
+type MergeOptions struct {
+	// AppendSlices concatenates slice values instead of replacing them.
+	AppendSlices bool
+
+	// OverrideSlices replaces slice values wholesale with the incoming
+	// value. Takes precedence over AppendSlices if both are set.
+	OverrideSlices bool
+
+	// ErrorOnConflict causes any key present with a non-zero value on both
+	// sides to be reported as a conflict, even when the incoming value
+	// would otherwise just overwrite the existing one.
+	ErrorOnConflict bool
+
+	// Override lets zero/empty incoming values overwrite existing non-empty
+	// ones. By default a zero value never clobbers a non-zero one, so
+	// layering sparse overrides on top of a fully-populated map is safe.
+	Override bool
+}
+
+// MergeOption configures a MergeOptions for a single deep-merge call.
+type MergeOption func(*MergeOptions)
+
+// WithOverride lets zero/empty values in the incoming source overwrite
+// existing non-empty values instead of being skipped.
+func WithOverride() MergeOption {
+	return func(o *MergeOptions) { o.Override = true }
+}
+
+// WithAppendSlices concatenates slice values found on both sides of a merge
+// instead of replacing the existing slice with the incoming one.
+func WithAppendSlices() MergeOption {
+	return func(o *MergeOptions) { o.AppendSlices = true }
+}
+
+// WithOverrideSlices replaces slice values wholesale with the incoming
+// value, the default behavior, made explicit for callers that also set
+// WithAppendSlices elsewhere in the chain.
+func WithOverrideSlices() MergeOption {
+	return func(o *MergeOptions) { o.OverrideSlices = true }
+}
+
+// WithErrorOnConflict reports an error for any key that's set to a
+// non-zero value on both sides of the merge, instead of silently letting
+// the incoming value win.
+func WithErrorOnConflict() MergeOption {
+	return func(o *MergeOptions) { o.ErrorOnConflict = true }
+}
+
+func resolveMergeOptions(opts []MergeOption) MergeOptions {
+	var options MergeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// MergeMapDeep recursively merges the entries of other into the context.
+// Where both sides hold a map[string]interface{} for the same key, their
+// entries are merged rather than the existing map being replaced wholesale.
+// Conflicting, type-mismatched values are collected into a *multierror.Error
+// describing the offending key path (e.g. "labels.env: cannot merge string
+// into map") rather than aborting the merge.
+func (builder *ContextBuilder) MergeMapDeep(other map[string]interface{}, opts ...MergeOption) *ContextBuilder {
+	builder.applyMapDeep("MergeMapDeep", other, resolveMergeOptions(opts))
+	return builder
+}
+
+// applyMapDeep is the shared implementation behind MergeMapDeep and the
+// compose-file-style MergeFile/MergeFiles/MergeReader: it recursively
+// merges values into the context and records its provenance under source,
+// all sharing one merge-order index.
+func (builder *ContextBuilder) applyMapDeep(source string, values map[string]interface{}, options MergeOptions) {
+	index := builder.beginMerge()
+
+	before := builder.context
+	merged, errs, erroredKeys := deepMergeMaps(before, values, "", options)
+	builder.context = merged
+	for _, err := range errs {
+		builder.appendErr(err)
+	}
+
+	// Provenance is recorded per top-level key rather than per leaf path: a
+	// deep merge can touch values several levels into an existing map, and
+	// attributing each of those individually would mean re-walking the whole
+	// merge a second time just for bookkeeping. A key only gets a new Origin
+	// if the merge actually changed its value or failed trying to - a
+	// zero-value that was skipped because it doesn't clobber an existing
+	// value is not a write, and recording one anyway would misrepresent the
+	// audit trail.
+	for k, raw := range values {
+		if erroredKeys[k] || !reflect.DeepEqual(before[k], merged[k]) {
+			builder.recordOrigin(k, Origin{Source: source, Index: index, RawValue: raw})
+		}
+	}
+}
+
+// MergeJsonObjectDeep unmarshals raw as a JSON object and deep-merges its
+// entries into the context. See MergeMapDeep.
+func (builder *ContextBuilder) MergeJsonObjectDeep(raw json.RawMessage, opts ...MergeOption) *ContextBuilder {
+	if len(raw) == 0 {
+		return builder
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	builder.applyMapDeep("MergeJsonObjectDeep", parsed, resolveMergeOptions(opts))
+	return builder
+}
+
+// MergeStructDeep marshals v to JSON and deep-merges the result into the
+// context. See MergeMapDeep.
+func (builder *ContextBuilder) MergeStructDeep(v interface{}, opts ...MergeOption) *ContextBuilder {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		builder.appendErr(err)
+		return builder
+	}
+
+	builder.applyMapDeep("MergeStructDeep", parsed, resolveMergeOptions(opts))
+	return builder
+}
+
+// deepMergeMaps merges src into dst, returning the merged map, any errors
+// encountered, and the set of src's own top-level keys that one of those
+// errors was attributed to. A conflict on one key must not cost the merge
+// its other, unrelated keys, so a key that errors keeps its old value while
+// every other key - at this level and within any nested map - still merges.
+func deepMergeMaps(dst, src map[string]interface{}, path string, opts MergeOptions) (map[string]interface{}, []error, map[string]bool) {
+	result := make(map[string]interface{}, len(dst))
+	for k, v := range dst {
+		result[k] = v
+	}
+
+	var errs []error
+	erroredKeys := map[string]bool{}
+	for k, incoming := range src {
+		keyPath := joinPath(path, k)
+
+		existing, exists := result[k]
+		if !exists {
+			result[k] = incoming
+			continue
+		}
+
+		merged, mergeErrs := deepMergeValue(existing, incoming, keyPath, opts)
+		errs = append(errs, mergeErrs...)
+		if len(mergeErrs) > 0 {
+			erroredKeys[k] = true
+		}
+		if merged != nil || len(mergeErrs) == 0 {
+			result[k] = merged
+		}
+	}
+
+	return result, errs, erroredKeys
+}
+
+func deepMergeValue(existing, incoming interface{}, path string, opts MergeOptions) (interface{}, []error) {
+	existingMap, existingIsMap := existing.(map[string]interface{})
+	incomingMap, incomingIsMap := incoming.(map[string]interface{})
+	if existingIsMap && incomingIsMap {
+		merged, errs, _ := deepMergeMaps(existingMap, incomingMap, path, opts)
+		return merged, errs
+	}
+
+	existingSlice, existingIsSlice := existing.([]interface{})
+	incomingSlice, incomingIsSlice := incoming.([]interface{})
+	if existingIsSlice && incomingIsSlice {
+		switch {
+		case opts.ErrorOnConflict && len(existingSlice) > 0 && len(incomingSlice) > 0:
+			return nil, []error{fmt.Errorf("%s: conflicting values %v and %v", path, existing, incoming)}
+		case len(incomingSlice) == 0 && len(existingSlice) > 0 && !opts.Override:
+			return existing, nil
+		case opts.OverrideSlices:
+			return incoming, nil
+		case opts.AppendSlices:
+			out := make([]interface{}, 0, len(existingSlice)+len(incomingSlice))
+			out = append(out, existingSlice...)
+			out = append(out, incomingSlice...)
+			return out, nil
+		default:
+			return incoming, nil
+		}
+	}
+
+	if existingIsMap != incomingIsMap || existingIsSlice != incomingIsSlice {
+		return nil, []error{fmt.Errorf("%s: cannot merge %s into %s", path, describeType(incoming), describeType(existing))}
+	}
+
+	// Both sides are scalars at this point; a type mismatch between them
+	// (string vs int, bool vs float, etc.) is just as much a conflict as a
+	// scalar-vs-map one is, and gets reported the same way. Numeric types are
+	// exempt from this check: YAML decodes integers as int while JSON always
+	// decodes numbers as float64, so merging the same numeric field from a
+	// YAML file and a JSON file must not be treated as a type mismatch.
+	if existing != nil && incoming != nil && !(isNumeric(existing) && isNumeric(incoming)) && reflect.TypeOf(existing) != reflect.TypeOf(incoming) {
+		return nil, []error{fmt.Errorf("%s: cannot merge %s into %s", path, describeType(incoming), describeType(existing))}
+	}
+
+	if opts.ErrorOnConflict && !isZero(existing) && !isZero(incoming) {
+		return nil, []error{fmt.Errorf("%s: conflicting values %v and %v", path, existing, incoming)}
+	}
+
+	if isZero(incoming) && !isZero(existing) && !opts.Override {
+		return existing, nil
+	}
+
+	return incoming, nil
+}
+
+func joinPath(base, key string) string {
+	if base == "" {
+		return key
+	}
+	return base + "." + key
+}
+
+func describeType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "slice"
+	case nil:
+		return "null"
+	default:
+		return reflect.TypeOf(v).String()
+	}
+}
+
+func isZero(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	return reflect.ValueOf(v).IsZero()
+}
+
+func isNumeric(v interface{}) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestContextBuilder_MergeMapDeep(t *testing.T) {
+	cases := map[string]struct {
+		Builder     *ContextBuilder
+		Expected    map[string]interface{}
+		ErrContains string
+	}{
+		"merges nested maps instead of overwriting": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": "prod", "team": "core"}}).
+				MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": "staging"}}),
+			Expected: map[string]interface{}{"labels": map[string]interface{}{"env": "staging", "team": "core"}},
+		},
+		"zero values don't clobber by default": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"name": "foo"}).
+				MergeMapDeep(map[string]interface{}{"name": ""}),
+			Expected: map[string]interface{}{"name": "foo"},
+		},
+		"WithOverride lets zero values win": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"name": "foo"}).
+				MergeMapDeep(map[string]interface{}{"name": ""}, WithOverride()),
+			Expected: map[string]interface{}{"name": ""},
+		},
+		"slices overwrite by default": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"tags": []interface{}{"a"}}).
+				MergeMapDeep(map[string]interface{}{"tags": []interface{}{"b"}}),
+			Expected: map[string]interface{}{"tags": []interface{}{"b"}},
+		},
+		"WithAppendSlices concatenates": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"tags": []interface{}{"a"}}).
+				MergeMapDeep(map[string]interface{}{"tags": []interface{}{"b"}}, WithAppendSlices()),
+			Expected: map[string]interface{}{"tags": []interface{}{"a", "b"}},
+		},
+		"type mismatch errors with a path": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": "prod"}}).
+				MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": map[string]interface{}{"nested": true}}}),
+			ErrContains: "labels.env: cannot merge map into string",
+		},
+		"scalar type mismatch errors with a path": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"count": "5"}).
+				MergeMapDeep(map[string]interface{}{"count": 5}),
+			ErrContains: "count: cannot merge int into string",
+		},
+		"numeric types merge across int and float64": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"count": 5}).
+				MergeMapDeep(map[string]interface{}{"count": float64(6)}),
+			Expected: map[string]interface{}{"count": float64(6)},
+		},
+		"WithErrorOnConflict rejects a live overwrite": {
+			Builder: Builder().
+				MergeMapDeep(map[string]interface{}{"name": "foo"}).
+				MergeMapDeep(map[string]interface{}{"name": "bar"}, WithErrorOnConflict()),
+			ErrContains: "name: conflicting values",
+		},
+	}
+
+	for tn, tc := range cases {
+		t.Run(tn, func(t *testing.T) {
+			vc, err := tc.Builder.Build()
+
+			if vc == nil && tc.Expected != nil {
+				t.Fatalf("Expected: %v, got: %v", tc.Expected, vc)
+			}
+
+			if vc != nil && !reflect.DeepEqual(vc.ToMap(), tc.Expected) {
+				t.Errorf("Expected: %v, got: %v", tc.Expected, vc.ToMap())
+			}
+
+			switch {
+			case err == nil && tc.ErrContains == "":
+				break
+			case err == nil && tc.ErrContains != "":
+				t.Errorf("Got no error when %q was expected", tc.ErrContains)
+			case err != nil && tc.ErrContains == "":
+				t.Errorf("Got error %v when none was expected", err)
+			case !strings.Contains(err.Error(), tc.ErrContains):
+				t.Errorf("Got error %v, but expected it to contain %q", err, tc.ErrContains)
+			}
+		})
+	}
+}
+
+// A conflict Build() reports still leaves the builder's context in a usable
+// state, so this checks it directly rather than through Build(), which
+// returns a nil *VarContext whenever any error was recorded.
+func TestContextBuilder_MergeMapDeep_PartialConflictKeepsSiblings(t *testing.T) {
+	builder := Builder().
+		MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": "prod", "team": "core"}}).
+		MergeMapDeep(map[string]interface{}{"labels": map[string]interface{}{"env": 5, "region": "us"}})
+
+	if _, err := builder.Build(); err == nil || !strings.Contains(err.Error(), "labels.env: cannot merge int into string") {
+		t.Fatalf("expected a labels.env conflict error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{"env": "prod", "team": "core", "region": "us"}
+	if got := builder.context["labels"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected only the conflicting key to be reverted, got: %v", got)
+	}
+}
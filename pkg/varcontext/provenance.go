@@ -0,0 +1,126 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Origin records a single write to a context key: which Merge* call made
+// it, its position in the overall merge order, and the raw value it was
+// given before any template evaluation.
+type Origin struct {
+	// Source names the Merge* call that set the value, e.g. "MergeMap" or
+	// "MergeFile(tile.yaml)".
+	Source string
+	// Index is this merge call's position in the order Merge* methods were
+	// invoked on the builder, starting at 1.
+	Index int
+	// RawValue is the value as it was passed in, before template
+	// evaluation - useful for telling an evaluated "${region}" apart from
+	// its literal source.
+	RawValue interface{}
+}
+
+// Provenance returns the history of every value key was set to, in the
+// order it was merged. A key set once has a single Origin; a key
+// overridden by a later merge has one Origin per write, oldest first. A deep
+// merge that failed on key also leaves an Origin for the attempt, although
+// the key keeps its earlier value.
+func (builder *ContextBuilder) Provenance(key string) []Origin {
+	origins := builder.provenance[key]
+	out := make([]Origin, len(origins))
+	copy(out, origins)
+	return out
+}
+
+// errorCount returns the number of errors accumulated on the builder so
+// far, used by the *E methods below to isolate just the error (if any)
+// their own call contributed.
+func (builder *ContextBuilder) errorCount() int {
+	if builder.errs == nil {
+		return 0
+	}
+	return len(builder.errs.Errors)
+}
+
+// errorsSince returns the errors appended to the builder after before,
+// collapsed the same way Build() would, or nil if there weren't any.
+func (builder *ContextBuilder) errorsSince(before int) error {
+	if builder.errs == nil || len(builder.errs.Errors) <= before {
+		return nil
+	}
+
+	newErrs := builder.errs.Errors[before:]
+	merr := &multierror.Error{Errors: append([]error{}, newErrs...), ErrorFormat: errorListFormat}
+	return merr.ErrorOrNil()
+}
+
+// MergeMapE is MergeMap for callers that want to check for a merge error as
+// soon as it happens rather than waiting for Build(). The error is also
+// still recorded on the builder, so Build() continues to see it even if a
+// caller ignores the return value here.
+func (builder *ContextBuilder) MergeMapE(other map[string]interface{}) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeMap(other)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeJsonObjectE is MergeJsonObject with eager error checking. See
+// MergeMapE.
+func (builder *ContextBuilder) MergeJsonObjectE(raw json.RawMessage) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeJsonObject(raw)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeStructE is MergeStruct with eager error checking. See MergeMapE.
+func (builder *ContextBuilder) MergeStructE(v interface{}) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeStruct(v)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeEvalResultE is MergeEvalResult with eager error checking. See
+// MergeMapE.
+func (builder *ContextBuilder) MergeEvalResultE(name, template string) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeEvalResult(name, template)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeMapDeepE is MergeMapDeep with eager error checking. See MergeMapE.
+func (builder *ContextBuilder) MergeMapDeepE(other map[string]interface{}, opts ...MergeOption) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeMapDeep(other, opts...)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeFileE is MergeFile with eager error checking. See MergeMapE.
+func (builder *ContextBuilder) MergeFileE(path string) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeFile(path)
+	return builder, builder.errorsSince(before)
+}
+
+// MergeReaderE is MergeReader with eager error checking. See MergeMapE.
+func (builder *ContextBuilder) MergeReaderE(r io.Reader, format Format) (*ContextBuilder, error) {
+	before := builder.errorCount()
+	builder.MergeReader(r, format)
+	return builder, builder.errorsSince(before)
+}
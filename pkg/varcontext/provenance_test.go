@@ -0,0 +1,107 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestContextBuilder_Provenance(t *testing.T) {
+	builder := Builder().
+		MergeMap(map[string]interface{}{"region": "us-central1"}).
+		MergeMap(map[string]interface{}{"region": "us-east1"})
+
+	origins := builder.Provenance("region")
+	if len(origins) != 2 {
+		t.Fatalf("expected 2 origins, got %d: %v", len(origins), origins)
+	}
+	if origins[0].Source != "MergeMap" || origins[0].RawValue != "us-central1" {
+		t.Errorf("unexpected first origin: %+v", origins[0])
+	}
+	if origins[1].Source != "MergeMap" || origins[1].RawValue != "us-east1" {
+		t.Errorf("unexpected second origin: %+v", origins[1])
+	}
+	if origins[1].Index <= origins[0].Index {
+		t.Errorf("expected merge order to increase, got %d then %d", origins[0].Index, origins[1].Index)
+	}
+
+	vc, err := builder.Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := vc.Provenance("region"); len(got) != 2 {
+		t.Errorf("expected VarContext to expose the same provenance, got %v", got)
+	}
+	if got := vc.Provenance("missing"); len(got) != 0 {
+		t.Errorf("expected no provenance for an unset key, got %v", got)
+	}
+}
+
+func TestContextBuilder_Provenance_DeepMergeOnlyRecordsAppliedWrites(t *testing.T) {
+	skipped := Builder().
+		MergeMapDeep(map[string]interface{}{"name": "foo"}).
+		MergeMapDeep(map[string]interface{}{"name": ""})
+
+	if origins := skipped.Provenance("name"); len(origins) != 1 {
+		t.Errorf("expected a zero value that didn't clobber to leave no new Origin, got %d: %v", len(origins), origins)
+	}
+
+	failed := Builder().
+		MergeMapDeep(map[string]interface{}{"count": "5"}).
+		MergeMapDeep(map[string]interface{}{"count": 5})
+
+	if origins := failed.Provenance("count"); len(origins) != 2 {
+		t.Errorf("expected a failed merge attempt to still be recorded, got %d: %v", len(origins), origins)
+	}
+}
+
+func TestContextBuilder_MergeJsonObjectE(t *testing.T) {
+	t.Run("valid JSON returns no error", func(t *testing.T) {
+		builder, err := Builder().MergeJsonObjectE(json.RawMessage(`{"a":"a"}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v, _ := builder.Build(); v.ToMap()["a"] != "a" {
+			t.Errorf("expected a=a, got %v", v.ToMap())
+		}
+	})
+
+	t.Run("invalid JSON is reported immediately", func(t *testing.T) {
+		_, err := Builder().MergeJsonObjectE(json.RawMessage(`{{{}}}`))
+		if err == nil || !strings.Contains(err.Error(), "invalid character") {
+			t.Errorf("expected an immediate error, got %v", err)
+		}
+	})
+
+	t.Run("a later valid call keeps the builder usable after an eager error", func(t *testing.T) {
+		builder, err := Builder().MergeJsonObjectE(json.RawMessage(`{{{}}}`))
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+
+		_, err = builder.MergeJsonObjectE(json.RawMessage(`{"a":"a"}`))
+		if err != nil {
+			t.Errorf("expected the second call to report no new error, got %v", err)
+		}
+
+		// Build() still aggregates every deferred error, including the
+		// first one, even though the eager call already reported it.
+		if _, err := builder.Build(); err == nil {
+			t.Errorf("expected Build() to still surface the earlier error")
+		}
+	})
+}
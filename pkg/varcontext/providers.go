@@ -0,0 +1,195 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ContextProvider is a named source of values that a ContextBuilder can
+// consult when resolving a key, either for a `${...}` template or through
+// Lookup. Built-in sources (env vars, lazily-fetched secrets) and brokerpak
+// authors' own sources implement this interface the same way.
+type ContextProvider interface {
+	// Lookup returns the value for key and whether it was found.
+	Lookup(key string) (interface{}, bool)
+	// Keys lists every key the provider can currently resolve.
+	Keys() []string
+	// Name identifies the provider in logs and provenance.
+	Name() string
+}
+
+// contextProviderPriority is the priority the context map built up by
+// MergeMap/MergeJsonObject/etc. is given relative to providers added with
+// WithProvider. Custom providers with a higher priority are consulted
+// first; ones with a lower priority act as a fallback underneath it.
+const contextProviderPriority = 0
+
+type providerEntry struct {
+	provider ContextProvider
+	priority int
+}
+
+// WithProvider registers an additional ContextProvider, consulted by
+// Lookup and by `${...}` templates. Providers are consulted in descending
+// priority order; the first one that has the key wins. The in-memory
+// context built up by MergeMap and friends always participates, at
+// contextProviderPriority (0) - pass a priority above or below that to
+// have a custom provider override or fall back to it.
+func (builder *ContextBuilder) WithProvider(p ContextProvider, priority int) *ContextBuilder {
+	builder.providers = append(builder.providers, providerEntry{provider: p, priority: priority})
+	return builder
+}
+
+// Lookup resolves key against every registered provider, in descending
+// priority order, returning the first match.
+func (builder *ContextBuilder) Lookup(key string) (interface{}, bool) {
+	for _, entry := range builder.orderedProviders() {
+		if value, ok := entry.provider.Lookup(key); ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func (builder *ContextBuilder) orderedProviders() []providerEntry {
+	all := make([]providerEntry, 0, len(builder.providers)+1)
+	all = append(all, builder.providers...)
+	all = append(all, providerEntry{provider: (*contextMapProvider)(builder), priority: contextProviderPriority})
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].priority > all[j].priority
+	})
+	return all
+}
+
+// contextMapProvider exposes a ContextBuilder's own merged context as a
+// ContextProvider, so it composes with custom providers added via
+// WithProvider instead of being a special case.
+type contextMapProvider ContextBuilder
+
+func (p *contextMapProvider) Lookup(key string) (interface{}, bool) {
+	value, ok := p.context[key]
+	return value, ok
+}
+
+func (p *contextMapProvider) Keys() []string {
+	keys := make([]string, 0, len(p.context))
+	for k := range p.context {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (p *contextMapProvider) Name() string { return "context" }
+
+// EnvProvider resolves keys from environment variables, optionally scoped
+// to a prefix so a brokerpak author can expose e.g. GSB_PROVISION_REGION as
+// just "region".
+type EnvProvider struct {
+	Prefix string
+}
+
+// NewEnvProvider creates an EnvProvider that only considers environment
+// variables starting with prefix, stripping it before matching keys.
+func NewEnvProvider(prefix string) *EnvProvider {
+	return &EnvProvider{Prefix: prefix}
+}
+
+func (p *EnvProvider) envName(key string) string {
+	return p.Prefix + strings.ToUpper(key)
+}
+
+// Lookup implements ContextProvider.
+func (p *EnvProvider) Lookup(key string) (interface{}, bool) {
+	return os.LookupEnv(p.envName(key))
+}
+
+// Keys implements ContextProvider.
+func (p *EnvProvider) Keys() []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, p.Prefix) {
+			continue
+		}
+		keys = append(keys, strings.ToLower(strings.TrimPrefix(name, p.Prefix)))
+	}
+	return keys
+}
+
+// Name implements ContextProvider.
+func (p *EnvProvider) Name() string { return "env" }
+
+// SecretFetchFunc retrieves a single secret value by key, e.g. from Vault
+// or Secret Manager.
+type SecretFetchFunc func(key string) (interface{}, error)
+
+// SecretProvider lazily fetches values on Lookup and caches the result, so
+// a context that never references a given secret never pays to fetch it.
+type SecretProvider struct {
+	name  string
+	fetch SecretFetchFunc
+
+	mu    sync.Mutex
+	cache map[string]interface{}
+}
+
+// NewSecretProvider creates a SecretProvider backed by fetch, named for use
+// in logs and provenance.
+func NewSecretProvider(name string, fetch SecretFetchFunc) *SecretProvider {
+	return &SecretProvider{name: name, fetch: fetch, cache: make(map[string]interface{})}
+}
+
+// Lookup implements ContextProvider, fetching and caching the secret on
+// first access. A failed fetch is treated as "not found" rather than
+// failing the whole merge, consistent with a provider simply not having
+// the key.
+func (p *SecretProvider) Lookup(key string) (interface{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if value, ok := p.cache[key]; ok {
+		return value, true
+	}
+
+	value, err := p.fetch(key)
+	if err != nil {
+		return nil, false
+	}
+
+	p.cache[key] = value
+	return value, true
+}
+
+// Keys implements ContextProvider. Secrets aren't enumerable without
+// fetching all of them up front, so only keys already resolved by Lookup
+// are reported.
+func (p *SecretProvider) Keys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]string, 0, len(p.cache))
+	for k := range p.cache {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Name implements ContextProvider.
+func (p *SecretProvider) Name() string { return p.name }
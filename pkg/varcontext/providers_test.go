@@ -0,0 +1,96 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeProvider struct {
+	name   string
+	values map[string]interface{}
+}
+
+func (p *fakeProvider) Lookup(key string) (interface{}, bool) {
+	v, ok := p.values[key]
+	return v, ok
+}
+
+func (p *fakeProvider) Keys() []string {
+	keys := make([]string, 0, len(p.values))
+	for k := range p.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func TestContextBuilder_WithProvider(t *testing.T) {
+	t.Run("higher priority provider wins", func(t *testing.T) {
+		builder := Builder().
+			MergeMap(map[string]interface{}{"region": "us-central1"}).
+			WithProvider(&fakeProvider{name: "override", values: map[string]interface{}{"region": "us-east1"}}, 10)
+
+		value, ok := builder.Lookup("region")
+		if !ok || value != "us-east1" {
+			t.Errorf("expected the higher priority provider to win, got %v (%v)", value, ok)
+		}
+	})
+
+	t.Run("lower priority provider falls back to context", func(t *testing.T) {
+		builder := Builder().
+			MergeMap(map[string]interface{}{"region": "us-central1"}).
+			WithProvider(&fakeProvider{name: "fallback", values: map[string]interface{}{"zone": "a"}}, -10)
+
+		value, ok := builder.Lookup("region")
+		if !ok || value != "us-central1" {
+			t.Errorf("expected the in-memory context to win, got %v (%v)", value, ok)
+		}
+	})
+
+	t.Run("templates consult the composite view", func(t *testing.T) {
+		vc, err := Builder().
+			WithProvider(&fakeProvider{name: "defaults", values: map[string]interface{}{"region": "us-central1"}}, 5).
+			MergeEvalResult("out", "${region}").
+			Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := vc.ToMap()["out"]; got != "us-central1" {
+			t.Errorf("expected out=us-central1, got %v", got)
+		}
+	})
+}
+
+func TestSecretProvider_LazilyFetchesAndCaches(t *testing.T) {
+	fetches := 0
+	provider := NewSecretProvider("secret-manager", func(key string) (interface{}, error) {
+		fetches++
+		return fmt.Sprintf("fetched-%s", key), nil
+	})
+
+	for i := 0; i < 3; i++ {
+		value, ok := provider.Lookup("db-password")
+		if !ok || value != "fetched-db-password" {
+			t.Fatalf("expected cached fetch result, got %v (%v)", value, ok)
+		}
+	}
+
+	if fetches != 1 {
+		t.Errorf("expected exactly one fetch due to caching, got %d", fetches)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Validate registers a JSON Schema that the fully-merged context must
+// satisfy. Validation runs once, in Build(), after every merge and template
+// evaluation has completed, so service authors get one place to catch bad
+// user parameters instead of scattering ad-hoc checks through provisioner
+// code. Schema violations are folded into the same *multierror.Error as
+// merge and template failures, each message prefixed with the JSON-pointer
+// path of the offending value (e.g. "/labels/env: ...").
+func (builder *ContextBuilder) Validate(schema json.RawMessage) *ContextBuilder {
+	builder.schemas = append(builder.schemas, gojsonschema.NewBytesLoader(schema))
+	return builder
+}
+
+// ValidateSchema registers an already-compiled JSON Schema, for callers that
+// validate the same schema across many ContextBuilders and want to pay the
+// compilation cost once.
+func (builder *ContextBuilder) ValidateSchema(schema *gojsonschema.Schema) *ContextBuilder {
+	builder.compiledSchemas = append(builder.compiledSchemas, schema)
+	return builder
+}
+
+// validate runs every registered schema against the accumulated context,
+// appending each violation to the builder's errors. It returns the builder's
+// errors, or nil when no schema is registered.
+func (builder *ContextBuilder) validate() error {
+	if len(builder.schemas) == 0 && len(builder.compiledSchemas) == 0 {
+		return nil
+	}
+
+	documentLoader := gojsonschema.NewGoLoader(builder.context)
+
+	for _, schemaLoader := range builder.schemas {
+		schema, err := gojsonschema.NewSchema(schemaLoader)
+		if err != nil {
+			builder.appendErr(fmt.Errorf("invalid JSON Schema: %v", err))
+			continue
+		}
+		builder.appendValidationResult(schema, documentLoader)
+	}
+
+	for _, schema := range builder.compiledSchemas {
+		builder.appendValidationResult(schema, documentLoader)
+	}
+
+	return builder.errs.ErrorOrNil()
+}
+
+func (builder *ContextBuilder) appendValidationResult(schema *gojsonschema.Schema, documentLoader gojsonschema.JSONLoader) {
+	result, err := schema.Validate(documentLoader)
+	if err != nil {
+		builder.appendErr(fmt.Errorf("couldn't validate context against schema: %v", err))
+		return
+	}
+
+	for _, resultErr := range result.Errors() {
+		builder.appendErr(fmt.Errorf("%s: %s", jsonPointer(resultErr.Field()), resultErr.Description()))
+	}
+}
+
+// jsonPointer converts a gojsonschema dotted field path, e.g. "(root)" or
+// "labels.env", into a JSON Pointer, e.g. "/labels/env".
+func jsonPointer(field string) string {
+	if field == "" || field == gojsonschema.STRING_ROOT_SCHEMA_PROPERTY {
+		return "/"
+	}
+	return "/" + strings.ReplaceAll(field, ".", "/")
+}
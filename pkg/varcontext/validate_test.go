@@ -0,0 +1,82 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"region": {"type": "string"},
+		"labels": {
+			"type": "object",
+			"properties": {
+				"env": {"type": "string", "pattern": "^[a-z]+$"}
+			}
+		}
+	},
+	"required": ["region"],
+	"additionalProperties": false
+}`)
+
+func TestContextBuilder_Validate(t *testing.T) {
+	cases := map[string]struct {
+		Builder     *ContextBuilder
+		ErrContains string
+	}{
+		"valid context passes": {
+			Builder: Builder().
+				MergeMap(map[string]interface{}{"region": "us-central1", "labels": map[string]interface{}{"env": "prod"}}).
+				Validate(testSchema),
+		},
+		"missing required key": {
+			Builder:     Builder().Validate(testSchema),
+			ErrContains: "/: region is required",
+		},
+		"pattern mismatch reports a JSON pointer path": {
+			Builder: Builder().
+				MergeMap(map[string]interface{}{"region": "us-central1", "labels": map[string]interface{}{"env": "prod!"}}).
+				Validate(testSchema),
+			ErrContains: "/labels/env:",
+		},
+		"additional properties rejected": {
+			Builder: Builder().
+				MergeMap(map[string]interface{}{"region": "us-central1", "extra": "nope"}).
+				Validate(testSchema),
+			ErrContains: "/: Additional property extra is not allowed",
+		},
+	}
+
+	for tn, tc := range cases {
+		t.Run(tn, func(t *testing.T) {
+			_, err := tc.Builder.Build()
+
+			switch {
+			case err == nil && tc.ErrContains == "":
+				break
+			case err == nil && tc.ErrContains != "":
+				t.Errorf("Got no error when %q was expected", tc.ErrContains)
+			case err != nil && tc.ErrContains == "":
+				t.Errorf("Got error %v when none was expected", err)
+			case !strings.Contains(err.Error(), tc.ErrContains):
+				t.Errorf("Got error %v, but expected it to contain %q", err, tc.ErrContains)
+			}
+		})
+	}
+}
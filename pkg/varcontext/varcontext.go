@@ -0,0 +1,88 @@
+// Copyright 2018 the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package varcontext
+
+import "encoding/json"
+
+// VarContext holds the fully-resolved set of key/value pairs produced by a
+// ContextBuilder once all of its merges and template evaluations have been
+// applied. It is immutable; create a new one by running a ContextBuilder
+// through Build().
+type VarContext struct {
+	context    map[string]interface{}
+	provenance map[string][]Origin
+}
+
+// newVarContext copies an already-resolved map of values and the provenance
+// recorded for them while they were being merged, so later merges on the
+// builder don't change the VarContext.
+func newVarContext(context map[string]interface{}, provenance map[string][]Origin) *VarContext {
+	values := make(map[string]interface{}, len(context))
+	for k, v := range context {
+		values[k] = v
+	}
+	origins := make(map[string][]Origin, len(provenance))
+	for k, v := range provenance {
+		origins[k] = append([]Origin{}, v...)
+	}
+	return &VarContext{context: values, provenance: origins}
+}
+
+// Provenance returns the history of every value key was set to, in the
+// order it was merged, so callers can explain e.g. "user parameter region
+// overrode tile default from plan foo" in an audit trail.
+func (vc *VarContext) Provenance(key string) []Origin {
+	origins := vc.provenance[key]
+	out := make([]Origin, len(origins))
+	copy(out, origins)
+	return out
+}
+
+// ToMap returns a copy of the resolved key/value pairs.
+func (vc *VarContext) ToMap() map[string]interface{} {
+	out := make(map[string]interface{}, len(vc.context))
+	for k, v := range vc.context {
+		out[k] = v
+	}
+	return out
+}
+
+// ToJson marshals the resolved context to a JSON object.
+func (vc *VarContext) ToJson() json.RawMessage {
+	raw, err := json.Marshal(vc.context)
+	if err != nil {
+		// context only ever holds values that ContextBuilder itself produced
+		// from JSON or JSON-marshalable sources, so this should never happen.
+		panic(err)
+	}
+	return raw
+}
+
+// GetString returns the value at key formatted as a string, or "" if it is
+// not present.
+func (vc *VarContext) GetString(key string) string {
+	v, ok := vc.context[key]
+	if !ok {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(raw)
+}